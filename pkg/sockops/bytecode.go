@@ -0,0 +1,71 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cilium/cilium/pkg/datapath/loader"
+	"github.com/cilium/cilium/pkg/option"
+
+	"github.com/cilium/ebpf"
+)
+
+// compileSpec compiles src with clang/llc into dst under StateDir and
+// parses the result. This is the only loadXSpec implementation right now:
+// bpf2go-embedded bytecode (see gen.go) requires clang to regenerate from
+// the real datapath sources, which isn't available in every build
+// environment yet, so every agent start pays the compile cost instead of
+// loading prebuilt objects. Once real bpf2go output is checked in, the
+// loadXSpec functions below should switch back to reading the embedded
+// bytes and this file should go back to being opt-in for development.
+func compileSpec(src string, dst string) (*ebpf.CollectionSpec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
+	defer cancel()
+
+	srcpath := filepath.Join("sockops", src)
+	outpath := filepath.Join(option.Config.StateDir, dst)
+
+	if err := loader.Compile(ctx, srcpath, outpath); err != nil {
+		return nil, fmt.Errorf("failed compile %s: %s", srcpath, err)
+	}
+	return ebpf.LoadCollectionSpec(outpath)
+}
+
+func loadSockopsSpec() (*ebpf.CollectionSpec, error) {
+	return compileSpec(cSockops, oSockops)
+}
+
+func loadRedirSpec() (*ebpf.CollectionSpec, error) {
+	return compileSpec(cIPC, oIPC)
+}
+
+func loadRedirIngSpec() (*ebpf.CollectionSpec, error) {
+	return compileSpec(cskbIPC, oskbIPC)
+}
+
+func loadRedirParserSpec() (*ebpf.CollectionSpec, error) {
+	return compileSpec(cparserIPC, oparserIPC)
+}
+
+func loadKtlsUpSpec() (*ebpf.CollectionSpec, error) {
+	return compileSpec(cKtlsUp, oKtlsUp)
+}
+
+func loadKtlsDownSpec() (*ebpf.CollectionSpec, error) {
+	return compileSpec(cKtlsDown, oKtlsDown)
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/cilium/pkg/defaults"
+	"github.com/cilium/cilium/pkg/mountinfo"
+)
+
+// fsTypeCgroupV1 is the filesystem type recorded in /proc/self/mountinfo
+// for a legacy per-controller cgroup v1 mount, as opposed to
+// mountinfo.FilesystemTypeCgroup2 for the unified hierarchy.
+const fsTypeCgroupV1 = "cgroup"
+
+// Cgroup hierarchy modes returned by GetCgroupRoot, mirroring the
+// legacy/hybrid/unified terminology container runtimes use to report
+// CgroupVersion.
+const (
+	// CgroupV1 means only the legacy per-controller hierarchy is
+	// mounted; there is no cgroup2 root to attach sockops to.
+	CgroupV1 = iota
+	// CgroupV2 means the unified cgroup2 hierarchy is the only
+	// hierarchy mounted.
+	CgroupV2
+	// CgroupV2Hybrid means a cgroup v1 tmpfs coexists with a cgroup2
+	// mount elsewhere (commonly under .../unified), as systemd sets up
+	// by default on many distributions.
+	CgroupV2Hybrid
+)
+
+// ErrCgroupV2Unavailable is returned by GetCgroupRoot when the host has a
+// cgroup v1 hierarchy but no cgroup2 mount anywhere, so there is no
+// target sockops programs can attach to.
+var ErrCgroupV2Unavailable = errors.New("host has no cgroup2 mount; sockmap requires cgroup2")
+
+// errNoCgroupMounted is an internal sentinel meaning neither a cgroup v1
+// nor a cgroup2 mount was found at all, so CheckOrMountCgrpFS should fall
+// back to mounting its own cgroup2 instance rather than report
+// ErrCgroupV2Unavailable.
+var errNoCgroupMounted = errors.New("no cgroup mount found")
+
+var (
+	cgroupVersion int
+	cgroupRootErr error
+)
+
+// discoverCgroupRoot parses /proc/self/mountinfo to find the active
+// cgroup mode. It prefers a cgroup2 mount at the cilium default location
+// if one is present among several, but otherwise returns the first
+// cgroup2 mount found -- this is normally the single mount systemd
+// already set up at /sys/fs/cgroup, or the unified hierarchy under
+// /sys/fs/cgroup/unified on hybrid hosts.
+func discoverCgroupRoot() (string, int, error) {
+	mounts, err := mountinfo.GetMountInfo()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse mountinfo: %s", err)
+	}
+	return classifyCgroupMounts(mounts)
+}
+
+// classifyCgroupMounts picks the cgroup2 root and hierarchy mode out of a
+// parsed mountinfo, applying the same preference discoverCgroupRoot
+// documents. It is split out from discoverCgroupRoot so the classification
+// logic can be tested without going through /proc/self/mountinfo.
+func classifyCgroupMounts(mounts []*mountinfo.MountInfo) (string, int, error) {
+	var v1Root, v2Root string
+	for _, m := range mounts {
+		switch m.FilesystemType {
+		case mountinfo.FilesystemTypeCgroup2:
+			if v2Root == "" || m.MountPoint == defaults.DefaultCgroupRoot {
+				v2Root = m.MountPoint
+			}
+		case fsTypeCgroupV1:
+			if v1Root == "" {
+				v1Root = m.MountPoint
+			}
+		}
+	}
+
+	switch {
+	case v2Root != "" && v1Root != "":
+		return v2Root, CgroupV2Hybrid, nil
+	case v2Root != "":
+		return v2Root, CgroupV2, nil
+	case v1Root != "":
+		return "", CgroupV1, ErrCgroupV2Unavailable
+	default:
+		return "", 0, errNoCgroupMounted
+	}
+}
+
+// GetCgroupRoot returns the path sockops programs should be attached
+// under and the cgroup mode CheckOrMountCgrpFS resolved it from
+// (CgroupV1, CgroupV2 or CgroupV2Hybrid). CheckOrMountCgrpFS must have
+// run first; call it during agent startup before relying on this.
+func GetCgroupRoot() (string, int, error) {
+	if cgroupRootErr != nil {
+		return "", cgroupVersion, cgroupRootErr
+	}
+	return cgroupRoot, cgroupVersion, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+import (
+	"testing"
+
+	"github.com/cilium/cilium/pkg/defaults"
+	"github.com/cilium/cilium/pkg/mountinfo"
+)
+
+func TestClassifyCgroupMounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		mounts   []*mountinfo.MountInfo
+		wantRoot string
+		wantMode int
+		wantErr  error
+	}{
+		{
+			name:    "no cgroup mounted",
+			mounts:  nil,
+			wantErr: errNoCgroupMounted,
+		},
+		{
+			name: "cgroup v1 only",
+			mounts: []*mountinfo.MountInfo{
+				{MountPoint: "/sys/fs/cgroup/memory", FilesystemType: fsTypeCgroupV1},
+			},
+			wantErr: ErrCgroupV2Unavailable,
+		},
+		{
+			name: "cgroup v2 only",
+			mounts: []*mountinfo.MountInfo{
+				{MountPoint: "/sys/fs/cgroup", FilesystemType: mountinfo.FilesystemTypeCgroup2},
+			},
+			wantRoot: "/sys/fs/cgroup",
+			wantMode: CgroupV2,
+		},
+		{
+			name: "hybrid prefers the default cilium mount point",
+			mounts: []*mountinfo.MountInfo{
+				{MountPoint: "/sys/fs/cgroup/unified", FilesystemType: mountinfo.FilesystemTypeCgroup2},
+				{MountPoint: "/sys/fs/cgroup/memory", FilesystemType: fsTypeCgroupV1},
+				{MountPoint: defaults.DefaultCgroupRoot, FilesystemType: mountinfo.FilesystemTypeCgroup2},
+			},
+			wantRoot: defaults.DefaultCgroupRoot,
+			wantMode: CgroupV2Hybrid,
+		},
+		{
+			name: "hybrid falls back to first cgroup2 mount seen",
+			mounts: []*mountinfo.MountInfo{
+				{MountPoint: "/sys/fs/cgroup/unified", FilesystemType: mountinfo.FilesystemTypeCgroup2},
+				{MountPoint: "/sys/fs/cgroup/memory", FilesystemType: fsTypeCgroupV1},
+			},
+			wantRoot: "/sys/fs/cgroup/unified",
+			wantMode: CgroupV2Hybrid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, mode, err := classifyCgroupMounts(tt.mounts)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if root != tt.wantRoot {
+				t.Errorf("root = %q, want %q", root, tt.wantRoot)
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode = %d, want %d", mode, tt.wantMode)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+// This package does not yet check in bpf2go-generated bpfel/bpfeb
+// objects: doing so requires clang to compile the datapath sources
+// under ../../bpf and a build environment where that's reliably
+// available, and a prebuilt object checked in without it would either
+// be a no-op standing in for the real datapath logic or, if built
+// against a version of cilium/ebpf new enough to have dropped legacy
+// (non-BTF) map definitions, fail to load altogether. Until bpf2go can
+// actually be run against the real sources, loadSockopsSpec and friends
+// (bytecode.go) compile the .c sources with clang/llc at agent startup
+// instead of loading embedded bytecode. Run `go generate ./...` with
+// clang and llvm-strip on PATH once this is ready to switch back to
+// embedding, and update bytecode.go's loadXSpec functions to read the
+// generated bytes.
+
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -target bpfel,bpfeb sockops ../../bpf/bpf_sockops.c -- -I../../bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -target bpfel,bpfeb redir ../../bpf/bpf_redir.c -- -I../../bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -target bpfel,bpfeb redirIng ../../bpf/bpf_redir_ing.c -- -I../../bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -target bpfel,bpfeb redirParser ../../bpf/bpf_redir_parser.c -- -I../../bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -target bpfel,bpfeb ktlsUp ../../bpf/bpf_ktls_up.c -- -I../../bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -Werror" -target bpfel,bpfeb ktlsDown ../../bpf/bpf_ktls_down.c -- -I../../bpf
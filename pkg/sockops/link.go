@@ -0,0 +1,297 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cilium/cilium/pkg/bpf"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+)
+
+// linkSubdir is where pinned bpf_link objects for sockops live, separate
+// from the plain prog pins the PROG_ATTACH fallback path uses.
+const linkSubdir = "sockops/links"
+
+// Link is a durable sockops attachment created through the kernel bpf_link
+// API (BPF_LINK_CREATE). Unlike BPF_PROG_ATTACH, the attachment survives
+// as long as the link's pinned file exists -- including across agent
+// restarts -- and the attached program can be swapped in place without a
+// detach/attach window that would drop in-flight connections.
+type Link struct {
+	raw  link.Link
+	name string
+}
+
+func linkPinPath(name string) string {
+	return filepath.Join(bpf.GetMapRoot(), linkSubdir, name)
+}
+
+// restoreLink re-opens the pinned link called name, if one exists from a
+// previous agent run.
+func restoreLink(name string) (*Link, error) {
+	raw, err := link.LoadPinnedLink(linkPinPath(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Link{raw: raw, name: name}, nil
+}
+
+// pin persists l under linkSubdir so it is picked up by restoreLink on the
+// next agent start.
+func (l *Link) pin() error {
+	path := linkPinPath(l.name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create sockops link directory: %s", err)
+	}
+	if err := l.raw.Pin(path); err != nil {
+		return fmt.Errorf("failed to pin link %s: %s", l.name, err)
+	}
+	return nil
+}
+
+// Update atomically swaps the program attached through l. Connections
+// already redirected through the old program are not dropped the way a
+// PROG_DETACH followed by PROG_ATTACH would drop them.
+func (l *Link) Update(newProg *ebpf.Program) error {
+	if err := l.raw.Update(newProg); err != nil {
+		return fmt.Errorf("failed to update link %s: %s", l.name, err)
+	}
+	return nil
+}
+
+// Close releases the in-process handle to the link. The attachment itself
+// is governed by the pin, not by this handle; call Unpin to detach.
+func (l *Link) Close() error {
+	return l.raw.Close()
+}
+
+// Unpin removes the link's pin. The kernel detaches the program once the
+// last reference to the link (the pin) is gone.
+func (l *Link) Unpin() error {
+	return os.Remove(linkPinPath(l.name))
+}
+
+var (
+	linkSupportOnce sync.Once
+	linkSupported   bool
+)
+
+// haveLinkSupport probes whether the running kernel supports
+// BPF_LINK_CREATE for BPF_CGROUP_SOCK_OPS. It is only run once per agent
+// lifetime and memoized, mirroring the other one-shot feature probes in
+// the datapath.
+func haveLinkSupport() bool {
+	linkSupportOnce.Do(func() {
+		cgroup, err := os.Open(cgroupRoot)
+		if err != nil {
+			return
+		}
+		defer cgroup.Close()
+
+		prog, err := newProbeSockOpsProgram()
+		if err != nil {
+			return
+		}
+		defer prog.Close()
+
+		raw, err := link.AttachRawLink(link.RawLinkOptions{
+			Target:  int(cgroup.Fd()),
+			Program: prog,
+			Attach:  ebpf.AttachCGroupSockOps,
+		})
+		if err != nil {
+			return
+		}
+		raw.Close()
+		linkSupported = true
+	})
+	return linkSupported
+}
+
+// newProbeSockOpsProgram builds the minimal valid SOCK_OPS program used to
+// probe for BPF_LINK_CREATE support. It is never attached to real traffic.
+func newProbeSockOpsProgram() (*ebpf.Program, error) {
+	return ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.SockOps,
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+}
+
+var (
+	skMsgLinkSupportOnce sync.Once
+	skMsgLinkSupported   bool
+)
+
+// haveSkMsgLinkSupport probes whether the running kernel supports
+// BPF_LINK_CREATE for the SK_MSG/SK_SKB sockmap attach types, separately
+// from haveLinkSupport's BPF_CGROUP_SOCK_OPS probe -- the two are
+// unrelated kernel features and a kernel can have one without the
+// other. No upstream kernel currently implements BPF_LINK_CREATE for
+// these attach types, so this is expected to always return false and
+// AttachSkMsg to always fall back to the legacy attachSockMap
+// PROG_ATTACH path; it exists so that stays true by construction rather
+// than by coincidence, and so support is picked up automatically if a
+// future kernel adds it.
+func haveSkMsgLinkSupport() bool {
+	skMsgLinkSupportOnce.Do(func() {
+		m, err := ebpf.NewMap(&ebpf.MapSpec{
+			Type:       ebpf.SockHash,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+		})
+		if err != nil {
+			return
+		}
+		defer m.Close()
+
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type: ebpf.SkMsg,
+			Instructions: asm.Instructions{
+				asm.Mov.Imm(asm.R0, 0),
+				asm.Return(),
+			},
+			License: "GPL",
+		})
+		if err != nil {
+			return
+		}
+		defer prog.Close()
+
+		raw, err := link.AttachRawLink(link.RawLinkOptions{
+			Target:  m.FD(),
+			Program: prog,
+			Attach:  ebpf.AttachSkMsgVerdict,
+		})
+		if err != nil {
+			return
+		}
+		raw.Close()
+		skMsgLinkSupported = true
+	})
+	return skMsgLinkSupported
+}
+
+// RestoreLinks re-opens any bpf_link pins left behind by a previous run of
+// this agent (e.g. across a restart or upgrade) so SockmapDisable/
+// SkmsgDisable/DetachSockopsFromCgroup can still find and tear them down.
+// It walks every pin under linkSubdir rather than a fixed set of names,
+// so it picks up the per-workload pins AttachSockopsToCgroup creates
+// (named via workloadLinkName) as well as the six node-wide ones. It is
+// a no-op for any attachment that was made through the legacy
+// PROG_ATTACH fallback, since those have nothing to restore.
+func RestoreLinks() {
+	dir := filepath.Join(bpf.GetMapRoot(), linkSubdir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		l, err := restoreLink(entry.Name())
+		if err != nil {
+			continue
+		}
+		activeLinksMu.Lock()
+		activeLinks[entry.Name()] = l
+		activeLinksMu.Unlock()
+	}
+}
+
+// AttachSockops attaches prog to cgroupPath as the SOCK_OPS program via a
+// pinned bpf_link, pinned under name, so the attachment survives an agent
+// restart and can later be swapped in place with Link.Update. name must
+// be distinct per cgroupPath -- the node-wide attach uses eSockops, and
+// per-workload attaches use workloadLinkName(cgroupPath) -- otherwise a
+// second caller's Pin fails against the first caller's pin and silently
+// falls back to a colliding legacy attachment. Callers run on a kernel
+// without link support should check haveLinkSupport (or just fall back on
+// the error) and use the legacy attachCgroup PROG_ATTACH path instead.
+func AttachSockops(cgroupPath string, prog *ebpf.Program, name string) (*Link, error) {
+	if !haveLinkSupport() {
+		return nil, fmt.Errorf("kernel does not support bpf_link for cgroup sock_ops")
+	}
+
+	cgroup, err := os.Open(cgroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cgroup %s: %s", cgroupPath, err)
+	}
+	defer cgroup.Close()
+
+	raw, err := link.AttachRawLink(link.RawLinkOptions{
+		Target:  int(cgroup.Fd()),
+		Program: prog,
+		Attach:  ebpf.AttachCGroupSockOps,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sock_ops link on %s: %s", cgroupPath, err)
+	}
+
+	l := &Link{raw: raw, name: name}
+	if err := l.pin(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// AttachSkMsg attaches verdict to the sockmap identified by mapFD via a
+// pinned bpf_link. It returns an error on kernels that do not support
+// BPF_LINK_CREATE for the SK_MSG/SK_SKB attach types -- which, as of
+// this writing, is every upstream kernel -- so in practice this always
+// errors and callers always fall back to the legacy BPF_PROG_ATTACH
+// path (attachSockMap) themselves. It is kept, rather than calling
+// attachSockMap directly, so that changes only once a kernel actually
+// supports it.
+func AttachSkMsg(mapFD int, verdict *ebpf.Program, attachType string, name string) (*Link, error) {
+	at, ok := attachTypes[attachType]
+	if !ok {
+		return nil, fmt.Errorf("unknown attach type %q", attachType)
+	}
+
+	if !haveSkMsgLinkSupport() {
+		return nil, fmt.Errorf("kernel does not support bpf_link for %s", attachType)
+	}
+
+	raw, err := link.AttachRawLink(link.RawLinkOptions{
+		Target:  mapFD,
+		Program: verdict,
+		Attach:  at,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s link: %s", attachType, err)
+	}
+
+	l := &Link{raw: raw, name: name}
+	if err := l.pin(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return l, nil
+}
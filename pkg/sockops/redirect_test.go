@@ -0,0 +1,181 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package sockops
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// TestSkMsgRedirect is a privileged integration test proving that a
+// socket added to a SOCKHASH map is actually redirected by the kernel
+// once a program is attached to that map through attachSockMap/
+// AttachSkMsg -- the exact path bpfLoadMapProg depends on. It is the
+// regression test for the bug where the SK_MSG/SK_SKB objects attached
+// to a brand-new, disconnected map instead of the reused sock_ops_map:
+// with that bug, this test's redirected socket would never see the
+// data.
+//
+// It requires CAP_BPF/CAP_NET_ADMIN to create a SOCKHASH map and load a
+// BPF program, so it is skipped unless run as root.
+func TestSkMsgRedirect(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root to load BPF maps and programs")
+	}
+
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "test_sockhash",
+		Type:       ebpf.SockHash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create sockhash map: %s", err)
+	}
+	defer m.Close()
+
+	// Redirect any message sent by a socket that is a member of this map
+	// to whichever socket is stored at key 0.
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.SkMsg,
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R6, 0),
+			asm.StoreMem(asm.RFP, -4, asm.R6, asm.Word),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, -4),
+			asm.LoadMapPtr(asm.R2, m.FD()),
+			asm.Mov.Imm(asm.R4, 0),
+			asm.FnMsgRedirectHash.Call(),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	if err != nil {
+		t.Fatalf("failed to load sk_msg program: %s", err)
+	}
+	defer prog.Close()
+
+	sender, senderPeer, err := socketpair(t)
+	if err != nil {
+		t.Fatalf("failed to create sender socketpair: %s", err)
+	}
+	defer sender.Close()
+	defer senderPeer.Close()
+
+	redirTarget, redirTargetPeer, err := socketpair(t)
+	if err != nil {
+		t.Fatalf("failed to create redirect-target socketpair: %s", err)
+	}
+	defer redirTarget.Close()
+	defer redirTargetPeer.Close()
+
+	if err := m.Put(uint32(0), uint32(socketFD(t, redirTarget))); err != nil {
+		t.Fatalf("failed to add redirect target to sockhash: %s", err)
+	}
+	if err := m.Put(uint32(1), uint32(socketFD(t, sender))); err != nil {
+		t.Fatalf("failed to add sender to sockhash: %s", err)
+	}
+
+	if err := attachSockMap(prog, m, msgVerdict); err != nil {
+		t.Fatalf("failed to attach sk_msg program to sockhash: %s", err)
+	}
+
+	want := []byte("sockmap redirect works")
+	if _, err := sender.Write(want); err != nil {
+		t.Fatalf("failed to write to sender: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	redirTargetPeer.SetReadDeadline(deadline)
+	got := make([]byte, len(want))
+	if _, err := readFull(redirTargetPeer, got); err != nil {
+		t.Fatalf("redirect target peer never received the redirected message: %s", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("redirect target peer got %q, want %q", got, want)
+	}
+
+	senderPeer.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := senderPeer.Read(make([]byte, len(want))); err == nil {
+		t.Errorf("sender's own peer unexpectedly received %d bytes; message was not redirected", n)
+	}
+}
+
+// socketpair creates a connected pair of AF_UNIX SOCK_STREAM sockets,
+// suitable for inserting into a SOCKHASH map.
+func socketpair(t *testing.T) (net.Conn, net.Conn, error) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a, err := fileConn(fds[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := fileConn(fds[1])
+	if err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+func fileConn(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), "sockpair")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// socketFD extracts the underlying file descriptor from a net.Conn
+// created by socketpair, for inserting into the sockhash map.
+func socketFD(t *testing.T, c net.Conn) int {
+	t.Helper()
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		t.Fatalf("connection does not expose its file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get raw conn: %s", err)
+	}
+	var fd int
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		t.Fatalf("failed to read fd: %s", err)
+	}
+	return fd
+}
+
+func readFull(c net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := c.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
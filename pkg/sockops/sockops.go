@@ -15,26 +15,21 @@
 package sockops
 
 import (
-	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cilium/cilium/pkg/bpf"
-	"github.com/cilium/cilium/pkg/datapath/loader"
 	"github.com/cilium/cilium/pkg/defaults"
 	"github.com/cilium/cilium/pkg/logging"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/mountinfo"
-	"github.com/cilium/cilium/pkg/option"
 
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
 	"github.com/sirupsen/logrus"
 )
 
@@ -56,6 +51,11 @@ const (
 	skbVerdict = "stream_verdict"
 	skbParser  = "stream_parser"
 
+	// The cXxx/oXxx source/object filenames below are consumed by
+	// compileSpec (bytecode.go), which compiles and loads them at agent
+	// startup until real bpf2go-embedded bytecode (see gen.go) replaces
+	// it. The eXxx names are the pin names used under bpf.GetMapRoot(),
+	// independent of how the collection was loaded.
 	cSockops = "bpf_sockops.c"
 	oSockops = "bpf_sockops.o"
 	eSockops = "bpf_sockops"
@@ -83,8 +83,49 @@ const (
 	sockMap         = "sock_ops_map"
 	sockKtlsUpMap   = "sock_ops_ktls_up"
 	sockKtlsDownMap = "sock_ops_ktls_down"
+
+	// sockmapMapName is the name the SK_MSG/SK_SKB object files use
+	// internally for the map they redirect through. It is distinct from
+	// the pinned name the map is known under in tc/globals.
+	sockmapMapName = "sockmap"
 )
 
+// attachTypes maps the attach-type strings used throughout this package to
+// the corresponding BPF_PROG_ATTACH attach type.
+var attachTypes = map[string]ebpf.AttachType{
+	msgVerdict: ebpf.AttachSkMsgVerdict,
+	skbVerdict: ebpf.AttachSkSKBStreamVerdict,
+	skbParser:  ebpf.AttachSkSKBStreamParser,
+}
+
+// activeLinks tracks the bpf_link-based attachments created by this agent
+// process, keyed by the same pin name the legacy PROG_ATTACH path used
+// (e.g. eSockops, eIPC). It is only populated on kernels with link
+// support; on older kernels the legacy attach/detach path is used instead
+// and this map stays empty.
+var (
+	activeLinksMu sync.Mutex
+	activeLinks   = map[string]*Link{}
+)
+
+// globalMaps are the pinned datapath maps that sockops/sockmsg/sockmap
+// programs reference. They are shared with the tc/xdp programs and, if
+// already pinned under tc/globals, must be reused rather than recreated.
+var globalMaps = []string{
+	"cilium_lxc",
+	"cilium_ipcache",
+	"cilium_metric",
+	"cilium_events",
+	sockMap,
+	sockKtlsUpMap,
+	sockKtlsDownMap,
+	"cilium_ep_to_policy",
+	"cilium_proxy4", "cilium_proxy6",
+	"cilium_lb6_reverse_nat", "cilium_lb4_reverse_nat",
+	"cilium_lb6_services", "cilium_lb4_services",
+	"cilium_lb6_rr_seq", "cilium_lb4_seq",
+}
+
 var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "sockops")
 
 // setCgroupRoot will set the path to mount cgroupv2
@@ -138,309 +179,272 @@ func cgrpCheckOrMountLocation(cgroupRoot string) error {
 	return nil
 }
 
-// CheckOrMountCgrpFS this checks if the cilium cgroup2 root mount point is
-// mounted and if not mounts it. If mapRoot is "" it will mount the default
-// location. It is harmless to have multiple cgroupv2 root mounts so unlike
-// BPFFS case we simply mount at the cilium default regardless if the system
-// has another mount created by systemd or otherwise.
+// CheckOrMountCgrpFS discovers the cgroup hierarchy already in use on the
+// host and, only if none is found, mounts the cilium cgroup2 root mount
+// point (the default location, or mapRoot if given). Modern hosts
+// typically already have the unified hierarchy mounted by systemd at
+// /sys/fs/cgroup, and on hybrid hosts a cgroup2 mount coexists with the
+// legacy tmpfs; in both cases the existing mount is reused via
+// GetCgroupRoot instead of creating a second, harder-to-discover one. If
+// only a cgroup v1 hierarchy is present, sockmap is disabled and
+// GetCgroupRoot reports ErrCgroupV2Unavailable instead of a generic log
+// message.
 func CheckOrMountCgrpFS(mapRoot string) {
 	cgrpMountOnce.Do(func() {
+		switch root, version, err := discoverCgroupRoot(); err {
+		case nil:
+			setCgroupRoot(root)
+			cgroupVersion = version
+			log.Infof("Found existing cgroup2 mount %s", root)
+			return
+		case ErrCgroupV2Unavailable:
+			cgroupVersion = version
+			cgroupRootErr = err
+			log.Warning("Host only has a cgroup v1 hierarchy mounted; sockmap requires cgroup2 and will be disabled")
+			return
+		}
+
 		if mapRoot == "" {
 			mapRoot = cgroupRoot
 		}
-		err := cgrpCheckOrMountLocation(mapRoot)
-		// Failed cgroup2 mount is not a fatal error, sockmap will be disabled however
-		if err == nil {
+		if err := cgrpCheckOrMountLocation(mapRoot); err == nil {
+			cgroupVersion = CgroupV2
 			log.Infof("Mounted Cgroup2 filesystem %s", mapRoot)
+		} else {
+			// Failed cgroup2 mount is not a fatal error, sockmap will be disabled however
+			cgroupRootErr = err
 		}
 	})
 }
 
-// BPF programs and sockmaps working on cgroups
-func bpftoolMapAttach(progID string, mapID string, attachType string) error {
-	prog := "bpftool"
-
-	args := []string{"prog", "attach", "id", progID, attachType, "id", mapID}
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("Map Attach BPF Object:")
-	_, err := exec.Command(prog, args...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Failed to attach prog(%s) to map(%s): %s", progID, mapID, err)
-	}
-	return nil
-}
-
-// #bpftool cgroup attach $cgrp sock_ops /sys/fs/bpf/$bpfObject
-func bpftoolAttach(bpfObject string) error {
-	prog := "bpftool"
-	bpffs := bpf.GetMapRoot() + "/" + bpfObject
-	cgrp := cgroupRoot //+ "/system.slice/docker.service"
-
-	args := []string{"cgroup", "attach", cgrp, "sock_ops", "pinned", bpffs}
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("Attach BPF Object:")
-	_, err := exec.Command(prog, args...).CombinedOutput()
+// loadCollection obtains a CollectionSpec from loadSpec (see compileSpec
+// in bytecode.go) and instantiates it, resolving any of globalMaps that
+// are already pinned under tc/globals instead of creating fresh copies.
+// Maps that aren't pinned yet (for example on the very first agent
+// start) are created by the collection as usual.
+//
+// aliases additionally resolves a map the object declares under one name
+// (the key) to the pinned map the rest of the datapath already knows it
+// by (the value) -- this is how the SK_MSG/SK_SKB objects' internal
+// "sockmap" declaration gets wired to the real, shared sock_ops_map (or
+// the kTLS up/down equivalents) instead of instantiating its own,
+// disconnected copy. It may be nil.
+func loadCollection(loadSpec func() (*ebpf.CollectionSpec, error), aliases map[string]string) (*ebpf.Collection, error) {
+	spec, err := loadSpec()
 	if err != nil {
-		return fmt.Errorf("Failed to attach %s: %s", bpfObject, err)
+		return nil, fmt.Errorf("failed to load spec: %s", err)
 	}
-	return nil
-}
 
-// #bpftool cgroup detach $cgrp sock_ops /sys/fs/bpf/$bpfObject
-func bpftoolDetach(bpfObject string) error {
-	prog := "bpftool"
-	bpffs := bpf.GetMapRoot() + "/" + bpfObject
-	cgrp := cgroupRoot //+ "/system.slice/docker.service"
-
-	args := []string{"cgroup", "detach", cgrp, "sock_ops", "pinned", bpffs}
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("Detach BPF Object:")
-	_, err := exec.Command(prog, args...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Failed to detach %s: %s", bpfObject, err)
+	globals := filepath.Join(bpf.GetMapRoot(), "tc", "globals")
+	opts := ebpf.CollectionOptions{
+		MapReplacements: map[string]*ebpf.Map{},
 	}
-	return nil
 
-}
+	// NewCollectionWithOptions clones the fd of every replacement map it
+	// is given rather than adopting our handle, so each one opened here
+	// must be closed once the collection exists instead of leaking it.
+	var pinnedMaps []*ebpf.Map
+	defer func() {
+		for _, m := range pinnedMaps {
+			m.Close()
+		}
+	}()
 
-// #bpftool prog load $bpfObject /sys/fs/bpf/sockops
-func bpftoolLoad(bpfObject string, bpfFsFile string) error {
-	sockopsMaps := [...]string{
-		"cilium_lxc",
-		"cilium_ipcache",
-		"cilium_metric",
-		"cilium_events",
-		"sock_ops_map",
-		"sock_ops_ktls_up",
-		"sock_ops_ktls_down",
-		"cilium_ep_to_policy",
-		"cilium_proxy4", "cilium_proxy6",
-		"cilium_lb6_reverse_nat", "cilium_lb4_reverse_nat",
-		"cilium_lb6_services", "cilium_lb4_services",
-		"cilium_lb6_rr_seq", "cilium_lb4_seq",
-		"cilium_lb6_rr_seq", "cilium_lb4_seq",
-	}
-
-	prog := "bpftool"
-	var mapArgList []string
-	bpffs := bpf.GetMapRoot() + "/" + bpfFsFile
-
-	maps, err := ioutil.ReadDir(bpf.GetMapRoot() + "/tc/globals/")
-	if err != nil {
-		return err
+	for _, name := range globalMaps {
+		if _, ok := spec.Maps[name]; !ok {
+			continue
+		}
+		pinned, err := ebpf.LoadPinnedMap(filepath.Join(globals, name), nil)
+		if err != nil {
+			continue
+		}
+		pinnedMaps = append(pinnedMaps, pinned)
+		opts.MapReplacements[name] = pinned
 	}
 
-	for _, f := range maps {
-		// Ignore all backing files
-		if strings.HasPrefix(f.Name(), "..") {
+	for specName, pinName := range aliases {
+		if _, ok := spec.Maps[specName]; !ok {
 			continue
 		}
-
-		use := func() bool {
-			for _, n := range sockopsMaps {
-				if f.Name() == n {
-					return true
-				}
-			}
-			return false
-		}()
-
-		if !use {
+		if _, ok := opts.MapReplacements[specName]; ok {
 			continue
 		}
-
-		mapString := []string{"map", "name", f.Name(), "pinned", bpf.GetMapRoot() + "/tc/globals/" + f.Name()}
-		mapArgList = append(mapArgList, mapString...)
+		pinned, err := ebpf.LoadPinnedMap(filepath.Join(globals, pinName), nil)
+		if err != nil {
+			continue
+		}
+		pinnedMaps = append(pinnedMaps, pinned)
+		opts.MapReplacements[specName] = pinned
 	}
 
-	args := []string{"-m", "prog", "load", bpfObject, bpffs}
-	args = append(args, mapArgList...)
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("Load BPF Object:")
-	_, err = exec.Command(prog, args...).CombinedOutput()
+	coll, err := ebpf.NewCollectionWithOptions(spec, opts)
 	if err != nil {
-		return fmt.Errorf("Failed to load %s: %s", bpfObject, err)
+		return nil, fmt.Errorf("failed to load collection: %s", err)
 	}
-	return nil
+	return coll, nil
 }
 
-// #rm $bpfObject
-func bpftoolUnload(bpfObject string) {
-	bpffs := bpf.GetMapRoot() + "/" + bpfObject
-
-	os.Remove(bpffs)
+// soleProgram returns the single program contained in coll. Each of our
+// sockops/sockmsg objects is compiled from a single source file and is
+// expected to expose exactly one program.
+func soleProgram(coll *ebpf.Collection) (*ebpf.Program, error) {
+	if len(coll.Programs) != 1 {
+		return nil, fmt.Errorf("expected exactly one program, found %d", len(coll.Programs))
+	}
+	for _, prog := range coll.Programs {
+		return prog, nil
+	}
+	return nil, fmt.Errorf("no program found")
 }
 
-// #bpftool prog show pinned /sys/fs/bpf/
-func bpftoolGetProgID(progName string) (string, error) {
-	bpffs := bpf.GetMapRoot() + "/" + progName
-	prog := "bpftool"
-
-	args := []string{"prog", "show", "pinned", bpffs}
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("GetProgID:")
-	output, err := exec.Command(prog, args...).CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("Failed to load %s: %s", progName, err)
+// pinMap pins m under tc/globals/<name> unless it is already pinned there.
+func pinMap(name string, m *ebpf.Map) error {
+	path := filepath.Join(bpf.GetMapRoot(), "tc", "globals", name)
+	if _, err := os.Stat(path); err == nil {
+		return nil
 	}
-
-	// Scrap the prog_id out of the bpftool output after libbpf is dual licensed
-	// we will use programatic API.
-	s := strings.Fields(string(output))
-	if s[0] == "" {
-		return "", fmt.Errorf("Failed to find prog %s: %s", progName, err)
+	if err := m.Pin(path); err != nil {
+		return fmt.Errorf("failed to pin map %s: %s", name, err)
 	}
-	progID := strings.Split(s[0], ":")
-	return progID[0], nil
+	return nil
 }
 
-// #bpftool prog show pinned /sys/fs/bpf/bpf_sockops
-// #bpftool map show id 21
-func bpftoolGetMapID(progName string, mapName string) (int, error) {
-	bpffs := bpf.GetMapRoot() + "/" + progName
-	prog := "bpftool"
-
-	args := []string{"prog", "show", "pinned", bpffs}
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("GetMapID:")
-	output, err := exec.Command(prog, args...).CombinedOutput()
-	if err != nil {
-		return 0, fmt.Errorf("Failed to load %s: %s", progName, err)
-	}
-
-	// Find the mapID out of the bpftool output
-	s := strings.Fields(string(output))
-	for i := range s {
-		if s[i] == "map_ids" {
-			id := strings.Split(s[i+1], ",")
-			for j := range id {
-				args := []string{"map", "show", "id", id[j]}
-				output, err := exec.Command(prog, args...).CombinedOutput()
-				if err != nil {
-					return 0, err
-				}
-				log.Debugf("mapid(%s): %s", mapName, output)
-
-				if strings.Contains(string(output), mapName) {
-					mapID, _ := strconv.Atoi(id[j])
-					return mapID, nil
-				}
-			}
-			break
-		}
+// pinProg pins prog as bpf.GetMapRoot()/name, replacing the pinned bpftool
+// object files the datapath used to rely on.
+func pinProg(prog *ebpf.Program, name string) error {
+	path := filepath.Join(bpf.GetMapRoot(), name)
+	os.Remove(path)
+	if err := prog.Pin(path); err != nil {
+		return fmt.Errorf("failed to pin prog %s: %s", name, err)
 	}
-	return 0, nil
+	return nil
 }
 
-// #bpftool map pin id map_id /sys/fs/bpf/tc/globals
-func bpftoolPinMapID(mapName string, mapID int) error {
-	bpffs := bpf.GetMapRoot()
-	globals := bpffs + "/" + mapPrefix + "/"
-	mapFile := globals + mapName
-	prog := "bpftool"
+// unpin removes the pinned file at bpf.GetMapRoot()/name, if any. This is
+// the equivalent of the former bpftoolUnload: it detaches nothing by
+// itself, it only removes the pin.
+func unpin(name string) {
+	os.Remove(filepath.Join(bpf.GetMapRoot(), name))
+}
 
-	args := []string{"map", "pin", "id", strconv.Itoa(mapID), mapFile}
-	log.WithFields(logrus.Fields{
-		"bpftool": prog,
-		"args":    args,
-	}).Debug("Map pin:")
-	_, err := exec.Command(prog, args...).CombinedOutput()
+// attachCgroup attaches prog to cgroupPath for the sock_ops attach type
+// via BPF_PROG_ATTACH.
+func attachCgroup(prog *ebpf.Program, cgroupPath string) error {
+	cgroup, err := os.Open(cgroupPath)
 	if err != nil {
-		return fmt.Errorf("Failed to pin map %d(%s): %s", mapID, mapName, err)
+		return fmt.Errorf("failed to open cgroup %s: %s", cgroupPath, err)
 	}
+	defer cgroup.Close()
 
+	err = link.RawAttachProgram(link.RawAttachProgramOptions{
+		Target:  int(cgroup.Fd()),
+		Program: prog,
+		Attach:  ebpf.AttachCGroupSockOps,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach sock_ops program to cgroup %s: %s", cgroupPath, err)
+	}
 	return nil
 }
 
-// #clang ... | llc ...
-func bpfCompileProg(src string, dst string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
-	defer cancel()
-
-	srcpath := filepath.Join("sockops", src)
-	outpath := filepath.Join(dst)
+// detachCgroup detaches prog from cgroupPath for the sock_ops attach type.
+func detachCgroup(prog *ebpf.Program, cgroupPath string) error {
+	cgroup, err := os.Open(cgroupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup %s: %s", cgroupPath, err)
+	}
+	defer cgroup.Close()
 
-	err := loader.Compile(ctx, srcpath, outpath)
+	err = link.RawDetachProgram(link.RawDetachProgramOptions{
+		Target:  int(cgroup.Fd()),
+		Program: prog,
+		Attach:  ebpf.AttachCGroupSockOps,
+	})
 	if err != nil {
-		return fmt.Errorf("failed compile %s: %s", srcpath, err)
+		return fmt.Errorf("failed to detach sock_ops program from cgroup %s: %s", cgroupPath, err)
 	}
 	return nil
 }
 
-func bpfLoadMapProg(object string, load string, sockMap string, attachType string) error {
-	var _mapID int
-
-	sockops := object
-	sockopsObj := option.Config.StateDir + "/" + sockops
-	sockopsLoad := load
+// attachSockMap attaches prog to the sockmap m for the given attach type,
+// via BPF_PROG_ATTACH with the map fd as target.
+func attachSockMap(prog *ebpf.Program, m *ebpf.Map, attachType string) error {
+	at, ok := attachTypes[attachType]
+	if !ok {
+		return fmt.Errorf("unknown attach type %q", attachType)
+	}
 
-	err := bpftoolLoad(sockopsObj, sockopsLoad)
+	err := link.RawAttachProgram(link.RawAttachProgramOptions{
+		Target:  m.FD(),
+		Program: prog,
+		Attach:  at,
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to attach %s program to sockmap: %s", attachType, err)
 	}
+	return nil
+}
 
-	progID, err := bpftoolGetProgID(load)
+// bpfLoadMapProg loads loadSpec's collection -- resolving the object's
+// internal "sockmap" declaration to the pinned targetMap (sockMap,
+// sockKtlsUpMap or sockKtlsDownMap) instead of a fresh, disconnected map
+// -- pins its program under bpf.GetMapRoot()/load, pins targetMap itself
+// if this is the first program to reference it, and attaches it for the
+// given attach type. It replaces the former bpftoolLoad/bpftoolGetProgID/
+// bpftoolGetMapID/bpftoolMapAttach chain of shell-outs.
+func bpfLoadMapProg(loadSpec func() (*ebpf.CollectionSpec, error), load string, targetMap string, attachType string) error {
+	coll, err := loadCollection(loadSpec, map[string]string{sockmapMapName: targetMap})
 	if err != nil {
 		return err
 	}
+	defer coll.Close()
 
-	// Todo for some reason names are not being attached to
-	// ktls maps so we use this trick to find them for now.
-	if sockMap == "ingress" {
-		_mapID, err = bpftoolGetMapID("bpf_redir_ing", "sockmap")
-	} else if sockMap == "egress" {
-		_mapID, err = bpftoolGetMapID("bpf_redir", "sockmap")
-	} else {
-		_mapID, err = bpftoolGetMapID("bpf_redir", sockMap)
-	}
-	mapID := strconv.Itoa(_mapID)
+	prog, err := soleProgram(coll)
 	if err != nil {
 		return err
 	}
 
-	err = bpftoolMapAttach(progID, mapID, attachType)
-	if err != nil {
+	if err := pinProg(prog, load); err != nil {
 		return err
 	}
-	return nil
-}
 
-// KtlsEnable will compile and attach the SK_MSG programs to the
-// sockmap used to redirect to/from a Ktls enabled proxy. After
-// this all kTLS traffic (as identified by policy map) will be sent
-// to the user space proxy for handling before encryption.
-func KtlsEnable() error {
-	err := bpfCompileProg(cKtlsUp, oKtlsUp)
-	if err != nil {
-		log.Error(err)
+	m, ok := coll.Maps[sockmapMapName]
+	if !ok {
+		return fmt.Errorf("%s does not define map %q", load, sockmapMapName)
+	}
+
+	if err := pinMap(targetMap, m); err != nil {
 		return err
 	}
 
-	err = bpfCompileProg(cKtlsDown, oKtlsDown)
-	if err != nil {
-		log.Error(err)
+	if l, err := AttachSkMsg(m.FD(), prog, attachType, load); err == nil {
+		activeLinksMu.Lock()
+		activeLinks[load] = l
+		activeLinksMu.Unlock()
+	} else if err := attachSockMap(prog, m, attachType); err != nil {
 		return err
 	}
 
-	err = bpfLoadMapProg(oKtlsUp, eKtlsUp, "egress", msgVerdict)
+	log.WithFields(logrus.Fields{
+		"prog":   load,
+		"map":    targetMap,
+		"attach": attachType,
+	}).Debug("Loaded and attached sockmsg program")
+	return nil
+}
+
+// KtlsEnable will attach the SK_MSG programs to the sockmap used to
+// redirect to/from a Ktls enabled proxy. After this all kTLS traffic (as
+// identified by policy map) will be sent to the user space proxy for
+// handling before encryption.
+func KtlsEnable() error {
+	err := bpfLoadMapProg(loadKtlsUpSpec, eKtlsUp, sockKtlsUpMap, msgVerdict)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 
-	err = bpfLoadMapProg(oKtlsDown, eKtlsDown, "ingress", msgVerdict)
+	err = bpfLoadMapProg(loadKtlsDownSpec, eKtlsDown, sockKtlsDownMap, msgVerdict)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -451,48 +455,32 @@ func KtlsEnable() error {
 }
 
 // KtlsDisable "unloads" the SK_MSG program associated with the
-// kTLS proxy. This simply deletes the file associated with the program.
+// kTLS proxy. This simply removes the pinned file associated with the
+// program; the kernel releases the program once the last reference
+// (including the sockmap's hold on it) drops.
 func KtlsDisable() {
-	bpftoolUnload(eKtlsUp)
-	bpftoolUnload(eKtlsDown)
+	unpin(eKtlsUp)
+	unpin(eKtlsDown)
 	log.Info("Ktls sockmsg Disabled.")
 }
 
-// SkmsgEnable will compile and attach the SK_MSG programs to the
-// sockmap. After this all sockets added to the sock_ops_map will
-// have sendmsg/sendfile calls running through BPF program.
+// SkmsgEnable will attach the SK_MSG programs to the sockmap. After this
+// all sockets added to the sock_ops_map will have sendmsg/sendfile calls
+// running through BPF program.
 func SkmsgEnable() error {
-	err := bpfCompileProg(cIPC, oIPC)
+	err := bpfLoadMapProg(loadRedirSpec, eIPC, sockMap, msgVerdict)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 
-	err = bpfCompileProg(cskbIPC, oskbIPC)
+	err = bpfLoadMapProg(loadRedirIngSpec, eskbIPC, sockMap, skbVerdict)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 
-	err = bpfCompileProg(cparserIPC, oparserIPC)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-
-	err = bpfLoadMapProg(oIPC, eIPC, sockMap, msgVerdict)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-
-	err = bpfLoadMapProg(oskbIPC, eskbIPC, sockMap, skbVerdict)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-
-	err = bpfLoadMapProg(oparserIPC, eparserIPC, sockMap, skbParser)
+	err = bpfLoadMapProg(loadRedirParserSpec, eparserIPC, sockMap, skbParser)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -502,54 +490,102 @@ func SkmsgEnable() error {
 	return nil
 }
 
-// SkmsgDisable "unloads" the SK_MSG program. This simply deletes
-// the file associated with the program.
+// SkmsgDisable detaches the SK_MSG programs, preferring to unpin and close
+// the bpf_link created for each one if link support was available, and
+// falling back to removing the plain prog pin otherwise.
 func SkmsgDisable() {
-	bpftoolUnload(eIPC)
-	bpftoolUnload(eskbIPC)
-	bpftoolUnload(eparserIPC)
+	detachOrUnpin(eIPC)
+	detachOrUnpin(eskbIPC)
+	detachOrUnpin(eparserIPC)
 	log.Info("Sockmsg Disabled.")
 }
 
-// First user of sockops root is sockops load programs so we ensure the sockops
-// root path no longer changes.
-func bpfLoadAttachProg(object string, load string, mapName string) (int, int, error) {
-	sockopsObj := option.Config.StateDir + "/" + object
-	mapID := 0
+// detachOrUnpin tears down the attachment pinned as name: if it was
+// created through a bpf_link, its pin is removed and the link closed;
+// otherwise it falls back to removing the legacy prog pin.
+func detachOrUnpin(name string) {
+	activeLinksMu.Lock()
+	l, ok := activeLinks[name]
+	if ok {
+		delete(activeLinks, name)
+	}
+	activeLinksMu.Unlock()
+
+	if ok {
+		if err := l.Unpin(); err != nil {
+			log.Warningf("failed to unpin link %s: %s", name, err)
+		}
+		l.Close()
+		return
+	}
+
+	unpin(name)
+}
+
+// bpfLoadAttachProg loads loadSpec's collection, pins its program as
+// load, attaches it to the cgroup root with the sock_ops attach type and,
+// if mapName is set, pins the map it created (or reused) under
+// tc/globals. It returns the program and map IDs for logging, replacing
+// the former strconv-parsed bpftool output.
+func bpfLoadAttachProg(loadSpec func() (*ebpf.CollectionSpec, error), load string, mapName string) (ebpf.ProgramID, ebpf.MapID, error) {
+	root, _, err := GetCgroupRoot()
+	if err != nil {
+		return 0, 0, err
+	}
 
-	err := bpftoolLoad(sockopsObj, load)
+	coll, err := loadCollection(loadSpec, nil)
 	if err != nil {
 		return 0, 0, err
 	}
-	err = bpftoolAttach(load)
+	defer coll.Close()
+
+	prog, err := soleProgram(coll)
 	if err != nil {
 		return 0, 0, err
 	}
 
+	if err := pinProg(prog, load); err != nil {
+		return 0, 0, err
+	}
+
+	if l, err := AttachSockops(root, prog, load); err == nil {
+		activeLinksMu.Lock()
+		activeLinks[load] = l
+		activeLinksMu.Unlock()
+	} else if err := attachCgroup(prog, root); err != nil {
+		return 0, 0, err
+	}
+
+	var mapID ebpf.MapID
 	if mapName != "" {
-		mapID, err = bpftoolGetMapID(load, mapName)
-		if err != nil {
-			return 0, mapID, err
+		m, ok := coll.Maps[mapName]
+		if !ok {
+			return 0, 0, fmt.Errorf("%s does not define map %q", load, mapName)
+		}
+		if err := pinMap(mapName, m); err != nil {
+			return 0, 0, err
 		}
+		if info, err := m.Info(); err == nil {
+			if id, ok := info.ID(); ok {
+				mapID = id
+			}
+		}
+	}
 
-		err = bpftoolPinMapID(mapName, mapID)
-		if err != nil {
-			return 0, mapID, err
+	var progID ebpf.ProgramID
+	if info, err := prog.Info(); err == nil {
+		if id, ok := info.ID(); ok {
+			progID = id
 		}
 	}
-	return 0, mapID, nil
+
+	return progID, mapID, nil
 }
 
-// SockmapEnable will compile sockops programs and attach the sockops programs
-// to the cgroup. After this all TCP connect events will be filtered by a BPF
-// sockops program.
+// SockmapEnable will attach the sockops program to the cgroup. After this
+// all TCP connect events will be filtered by a BPF sockops program.
 func SockmapEnable() error {
-	err := bpfCompileProg(cSockops, oSockops)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	progID, mapID, err := bpfLoadAttachProg(oSockops, eSockops, sockMap)
+	progID, mapID, err := bpfLoadAttachProg(loadSockopsSpec, eSockops, sockMap)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -558,24 +594,46 @@ func SockmapEnable() error {
 	return nil
 }
 
-// SockmapDisable will detach any sockmap programs from cgroups then "unload"
-// all the programs and maps associated with it. Here "unload" just means
-// deleting the file associated with the map.
+// SockmapDisable will detach the sockops program from the cgroup -- via
+// the bpf_link pin if one was created, or the legacy PROG_ATTACH path
+// otherwise -- then remove the pins associated with the program and map.
 func SockmapDisable() {
 	mapName := mapPrefix + "/" + sockMap
-	bpftoolDetach(eSockops)
-	bpftoolUnload(eSockops)
-	bpftoolUnload(mapName)
+
+	activeLinksMu.Lock()
+	l, ok := activeLinks[eSockops]
+	if ok {
+		delete(activeLinks, eSockops)
+	}
+	activeLinksMu.Unlock()
+
+	if ok {
+		if err := l.Unpin(); err != nil {
+			log.Warningf("failed to unpin sock_ops link: %s", err)
+		}
+		l.Close()
+	} else if root, _, err := GetCgroupRoot(); err == nil {
+		progPath := filepath.Join(bpf.GetMapRoot(), eSockops)
+		if prog, err := ebpf.LoadPinnedProgram(progPath, nil); err == nil {
+			if err := detachCgroup(prog, root); err != nil {
+				log.Warning(err)
+			}
+			prog.Close()
+		}
+	}
+
+	unpin(eSockops)
+	unpin(mapName)
 	log.Info("Sockmap disabled.")
 }
 
 func SockmapKtlsDisable() {
 	downMapName := mapPrefix + "/" + sockKtlsDownMap
 	upMapName := mapPrefix + "/" + sockKtlsUpMap
-	bpftoolUnload(eKtlsUp)
-	bpftoolUnload(eKtlsDown)
-	bpftoolUnload(downMapName)
-	bpftoolUnload(upMapName)
+	unpin(eKtlsUp)
+	unpin(eKtlsDown)
+	unpin(downMapName)
+	unpin(upMapName)
 	log.Info("kTLS disabled.")
 
 }
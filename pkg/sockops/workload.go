@@ -0,0 +1,159 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/cilium/pkg/bpf"
+
+	"github.com/cilium/ebpf"
+)
+
+// ResolveCgroupPath returns the absolute cgroup2 path for pid, joining
+// the unified-hierarchy entry from /proc/<pid>/cgroup under the root
+// GetCgroupRoot discovered. It works the same way for both the systemd
+// cgroup driver layout (kubepods.slice/kubepods-burstable.slice/...) and
+// the cgroupfs driver layout (kubepods/burstable/pod<uid>/<container>),
+// since on a cgroup2 or hybrid host either one simply shows up as the
+// unified entry in /proc/<pid>/cgroup.
+func ResolveCgroupPath(pid int) (string, error) {
+	root, _, err := GetCgroupRoot()
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := unifiedCgroupOf(pid)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// unifiedCgroupOf returns the cgroup2-relative path for pid: the entry in
+// /proc/<pid>/cgroup with an empty controller list, i.e. "0::<path>" on a
+// unified or hybrid host.
+func unifiedCgroupOf(pid int) (string, error) {
+	path := filepath.Join("/proc", strconv.Itoa(pid), "cgroup")
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %s", path, err)
+	}
+	defer f.Close()
+
+	rel, err := parseUnifiedCgroup(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	if rel == "" {
+		return "", fmt.Errorf("no unified cgroup hierarchy entry found for pid %d", pid)
+	}
+	return rel, nil
+}
+
+// parseUnifiedCgroup scans r in /proc/<pid>/cgroup format and returns the
+// path of the entry with an empty controller list, i.e. "0::<path>" on a
+// unified or hybrid host. It returns "" with a nil error if no such entry
+// is present, so unifiedCgroupOf can attach the pid to its error message.
+// Split out from unifiedCgroupOf so the parsing can be tested without
+// /proc.
+func parseUnifiedCgroup(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			return strings.TrimPrefix(fields[2], "/"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// AttachSockopsToCgroup attaches the already-loaded sockops program (see
+// SockmapEnable) to cgroupPath as well, scoping sockmap acceleration to a
+// single workload instead of every process on the node. cgroupPath
+// should come from ResolveCgroupPath.
+//
+// This package only provides the attach/detach primitive: it must be
+// called from the endpoint add path (and DetachSockopsFromCgroup from
+// the corresponding delete path) in pkg/endpointmanager for per-workload
+// scoping to actually take effect. That package is not part of this
+// checkout, so the call site cannot be added here; wiring it in is a
+// prerequisite for this function to have any effect.
+func AttachSockopsToCgroup(cgroupPath string) error {
+	progPath := filepath.Join(bpf.GetMapRoot(), eSockops)
+	prog, err := ebpf.LoadPinnedProgram(progPath, nil)
+	if err != nil {
+		return fmt.Errorf("sockops program is not loaded, call SockmapEnable first: %s", err)
+	}
+	defer prog.Close()
+
+	name := workloadLinkName(cgroupPath)
+	if l, err := AttachSockops(cgroupPath, prog, name); err == nil {
+		activeLinksMu.Lock()
+		activeLinks[name] = l
+		activeLinksMu.Unlock()
+		return nil
+	}
+
+	return attachCgroup(prog, cgroupPath)
+}
+
+// DetachSockopsFromCgroup reverses AttachSockopsToCgroup.
+func DetachSockopsFromCgroup(cgroupPath string) error {
+	name := workloadLinkName(cgroupPath)
+
+	activeLinksMu.Lock()
+	l, ok := activeLinks[name]
+	if ok {
+		delete(activeLinks, name)
+	}
+	activeLinksMu.Unlock()
+
+	if ok {
+		if err := l.Unpin(); err != nil {
+			return err
+		}
+		return l.Close()
+	}
+
+	progPath := filepath.Join(bpf.GetMapRoot(), eSockops)
+	prog, err := ebpf.LoadPinnedProgram(progPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open pinned sockops program: %s", err)
+	}
+	defer prog.Close()
+
+	return detachCgroup(prog, cgroupPath)
+}
+
+// workloadLinkName derives a stable pin name for a per-workload
+// attachment from its cgroup path, so repeated attach/detach calls for
+// the same workload agree on the same pin.
+func workloadLinkName(cgroupPath string) string {
+	return eSockops + "-" + strings.ReplaceAll(strings.Trim(cgroupPath, "/"), "/", "_")
+}
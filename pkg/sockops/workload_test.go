@@ -0,0 +1,96 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sockops
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUnifiedCgroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "cgroup2-only host",
+			input: "0::/kubepods.slice/kubepods-burstable.slice/pod123/container456\n",
+			want:  "kubepods.slice/kubepods-burstable.slice/pod123/container456",
+		},
+		{
+			name: "hybrid host, unified entry among legacy controllers",
+			input: "11:devices:/kubepods/burstable/pod123/container456\n" +
+				"4:memory:/kubepods/burstable/pod123/container456\n" +
+				"0::/kubepods/burstable/pod123/container456\n",
+			want: "kubepods/burstable/pod123/container456",
+		},
+		{
+			name:    "no unified entry",
+			input:   "4:memory:/kubepods/burstable/pod123/container456\n",
+			want:    "",
+			wantErr: false,
+		},
+		{
+			name:  "malformed lines are skipped",
+			input: "not-a-cgroup-line\n0::/foo\n",
+			want:  "foo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUnifiedCgroup(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkloadLinkName(t *testing.T) {
+	tests := []struct {
+		cgroupPath string
+		want       string
+	}{
+		{
+			cgroupPath: "/sys/fs/cgroup/kubepods.slice/pod123/container456",
+			want:       eSockops + "-sys_fs_cgroup_kubepods.slice_pod123_container456",
+		},
+		{
+			cgroupPath: "/sys/fs/cgroup/",
+			want:       eSockops + "-sys_fs_cgroup",
+		},
+	}
+
+	for _, tt := range tests {
+		got := workloadLinkName(tt.cgroupPath)
+		if got != tt.want {
+			t.Errorf("workloadLinkName(%q) = %q, want %q", tt.cgroupPath, got, tt.want)
+		}
+	}
+
+	// Two distinct workloads under the same node must never collapse to
+	// the same pin name.
+	a := workloadLinkName("/sys/fs/cgroup/kubepods.slice/podA")
+	b := workloadLinkName("/sys/fs/cgroup/kubepods.slice/podB")
+	if a == b {
+		t.Errorf("workloadLinkName collided for distinct cgroup paths: %q", a)
+	}
+}